@@ -0,0 +1,247 @@
+// Copyright 2015 The go-ethereum Authors
+// Copyright 2018 The go-etherzero Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"math/big"
+	"sync"
+
+	"github.com/ethzero/go-ethzero/common"
+	"github.com/ethzero/go-ethzero/crypto"
+	"github.com/ethzero/go-ethzero/log"
+	"github.com/ethzero/go-ethzero/masternode"
+	"github.com/pkg/errors"
+)
+
+// beaconEpochLength is the number of blocks that share a single beacon
+// round, so a single entry can't be ground by racing to mine one particular
+// block.
+const beaconEpochLength = 64
+
+// BeaconSource supplies the per-round entropy mixed into masternode
+// selection scoring, so that a miner can no longer fully determine the
+// payment winner just by grinding the block hash it produces.
+type BeaconSource interface {
+	// Entry returns the beacon entry committed for round. Implementations
+	// must be deterministic: every honest caller asking for the same round
+	// must get back the same bytes.
+	Entry(ctx context.Context, round uint64) ([]byte, error)
+
+	// Verify reports whether cur is a legitimate successor to prev at round
+	// in this beacon's chain. round is bound into what's checked, not just
+	// advisory metadata, so a genuine (prev, cur) pair from one round can't
+	// be relabelled and replayed as another round's entry. It returns nil if
+	// and only if cur is acceptable.
+	Verify(round uint64, prev, cur []byte) error
+}
+
+// errBeaconInvalidEntry is returned by a BeaconSource.Verify when cur does
+// not legitimately follow prev, and surfaced by consensus code that rejects
+// payment votes referencing an unknown or unverifiable beacon round.
+var errBeaconInvalidEntry = errors.New("beacon: entry does not verify against previous round")
+
+// NullBeaconSource is the zero-configuration BeaconSource: it contributes no
+// entropy at all, so scoring falls back to exactly the pre-beacon behaviour
+// of mixing in only the block hash and masternode ID. It exists so that
+// beacon support can be rolled out without forcing every deployment to run
+// one immediately.
+type NullBeaconSource struct{}
+
+// Entry always returns an empty entry.
+func (NullBeaconSource) Entry(ctx context.Context, round uint64) ([]byte, error) {
+	return nil, nil
+}
+
+// Verify always succeeds: an empty chain has nothing to verify.
+func (NullBeaconSource) Verify(round uint64, prev, cur []byte) error {
+	return nil
+}
+
+// ChainedBeaconSource is a simple VRF-style beacon: round n's entry is this
+// node's ECDSA signature over keccak256(n || round n-1's entry), so every
+// round commits to both the one before it and its own round index, and
+// anyone holding the signer's public key can verify the chain - including
+// that a given entry really belongs to the round it's claimed for - without
+// trusting the signer.
+type ChainedBeaconSource struct {
+	key *ecdsa.PrivateKey
+	pub *ecdsa.PublicKey
+
+	mu      sync.Mutex
+	entries map[uint64][]byte
+}
+
+// chainedBeaconGenesis seeds round 0; every later round signs over the
+// keccak256 of its own round index and the previous round's entry.
+var chainedBeaconGenesis = crypto.Keccak256([]byte("go-etherzero masternode beacon genesis"))
+
+// beaconSignedHash is the digest ChainedBeaconSource signs and verifies for
+// round, binding the round index into the signed data so a genuine
+// (prev, cur) pair from one round can't be relabelled as another round's
+// entry.
+func beaconSignedHash(round uint64, prev []byte) []byte {
+	buf := make([]byte, 8, 8+len(prev))
+	binary.BigEndian.PutUint64(buf, round)
+	buf = append(buf, prev...)
+	return crypto.Keccak256(buf)
+}
+
+// NewChainedBeaconSource returns a ChainedBeaconSource that signs new
+// rounds with key and verifies rounds signed by pub (typically &key.PublicKey
+// on the node producing entries, and a peer's known public key everywhere
+// else).
+func NewChainedBeaconSource(key *ecdsa.PrivateKey, pub *ecdsa.PublicKey) *ChainedBeaconSource {
+	return &ChainedBeaconSource{
+		key:     key,
+		pub:     pub,
+		entries: make(map[uint64][]byte),
+	}
+}
+
+// Entry returns (deriving and caching it if necessary) the entry for round,
+// deriving every earlier round's entry first since each one depends on the
+// last.
+func (b *ChainedBeaconSource) Entry(ctx context.Context, round uint64) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prev := chainedBeaconGenesis
+	for r := uint64(0); r <= round; r++ {
+		if entry, ok := b.entries[r]; ok {
+			prev = entry
+			continue
+		}
+		if b.key == nil {
+			return nil, errors.Errorf("beacon: round %d not available and no signing key configured", r)
+		}
+		sig, err := crypto.Sign(beaconSignedHash(r, prev), b.key)
+		if err != nil {
+			return nil, err
+		}
+		b.entries[r] = sig
+		prev = sig
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+	}
+	return b.entries[round], nil
+}
+
+// Observe records an entry for round that this node learned about
+// externally (e.g. from a payment vote) rather than derived itself. Unlike
+// Entry, it requires no signing key, so a verify-only peer - constructed
+// with key == nil - can still build up its cache round by round as votes
+// arrive. It is a no-op if round is already cached.
+func (b *ChainedBeaconSource) Observe(round uint64, entry []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.entries[round]; ok {
+		return
+	}
+	b.entries[round] = entry
+}
+
+// Verify checks that cur is this beacon's signature, by the configured
+// public key, over beaconSignedHash(round, prev) - so cur only verifies for
+// the specific round it was produced for.
+func (b *ChainedBeaconSource) Verify(round uint64, prev, cur []byte) error {
+	pub, err := crypto.SigToPub(beaconSignedHash(round, prev), cur)
+	if err != nil {
+		return errors.Wrap(errBeaconInvalidEntry, err.Error())
+	}
+	if b.pub == nil || pub.X.Cmp(b.pub.X) != 0 || pub.Y.Cmp(b.pub.Y) != 0 {
+		return errBeaconInvalidEntry
+	}
+	return nil
+}
+
+// beaconRound maps a block to the beacon round whose entry should be mixed
+// into scores computed against it.
+func (mm *MasternodeManager) beaconRound(blockHash common.Hash) uint64 {
+	header := mm.blockchain.GetHeaderByHash(blockHash)
+	if header == nil {
+		return 0
+	}
+	return header.Number.Uint64() / beaconEpochLength
+}
+
+// scoreFor computes node's selection score for blockHash. With the
+// (default) NullBeaconSource it is exactly node.CalculateScore(blockHash),
+// unchanged from before beacon support existed; with any other BeaconSource
+// it mixes in that round's beacon entry so the block's miner can no longer
+// fully determine the outcome by grinding the block hash alone.
+func (mm *MasternodeManager) scoreFor(node *masternode.Masternode, blockHash common.Hash) *big.Int {
+	fallback := node.CalculateScore(blockHash)
+
+	if _, ok := mm.beacon.(NullBeaconSource); ok || mm.beacon == nil {
+		return fallback
+	}
+
+	entry, err := mm.beacon.Entry(context.Background(), mm.beaconRound(blockHash))
+	if err != nil {
+		log.Error("scoreFor: beacon entry unavailable, falling back to block-only score", "id", node.ID, "err", err)
+		return fallback
+	}
+
+	buf := make([]byte, 0, common.HashLength+len(entry)+len(node.ID))
+	buf = append(buf, blockHash.Bytes()...)
+	buf = append(buf, entry...)
+	buf = append(buf, []byte(node.ID)...)
+	return new(big.Int).SetBytes(crypto.Keccak256(buf))
+}
+
+// ValidateBeaconRound enforces the consensus rule that a payment vote may
+// only reference a beacon round this node can itself verify: round must not
+// be further in the future than the current beacon round, and entry must
+// verify against prevEntry - the previous round's entry, as carried by the
+// vote itself - under the configured BeaconSource. Validation never calls
+// BeaconSource.Entry to derive prevEntry, since that requires a signing key
+// a verify-only peer doesn't have; instead, once entry verifies, it is fed
+// back into the beacon's own cache via Observe so later votes referencing
+// this round don't need to re-supply it. It is a no-op (always valid) under
+// NullBeaconSource, since there is no beacon chain to check votes against.
+func (mm *MasternodeManager) ValidateBeaconRound(blockHash common.Hash, round uint64, prevEntry, entry []byte) error {
+	if _, ok := mm.beacon.(NullBeaconSource); ok || mm.beacon == nil {
+		return nil
+	}
+	if round > mm.beaconRound(blockHash) {
+		return errors.Errorf("beacon: round %d is ahead of the current round", round)
+	}
+
+	if round == 0 {
+		prevEntry = chainedBeaconGenesis
+	}
+	if err := mm.beacon.Verify(round, prevEntry, entry); err != nil {
+		return err
+	}
+
+	if chained, ok := mm.beacon.(*ChainedBeaconSource); ok {
+		if round > 0 {
+			chained.Observe(round-1, prevEntry)
+		}
+		chained.Observe(round, entry)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2015 The go-ethereum Authors
+// Copyright 2018 The go-etherzero Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"time"
+
+	"github.com/ethzero/go-ethzero/core/types"
+	"github.com/ethzero/go-ethzero/log"
+	"github.com/ethzero/go-ethzero/p2p"
+)
+
+const mnHandshakeTimeout = 5 * time.Second
+
+// runMasternodePeer is installed as the Run function of the masternode
+// p2p.Protocol. It performs the version handshake and, on success, pumps
+// messages for the peer until it disconnects or the manager shuts down.
+func (mm *MasternodeManager) runMasternodePeer(version uint, p *p2p.Peer, rw p2p.MsgReadWriter) error {
+	select {
+	case <-mm.noMorePeers:
+		return p2p.DiscQuitting
+	case <-mm.quitSync:
+		return p2p.DiscQuitting
+	default:
+	}
+
+	peer := newMnPeer(uint32(version), p, rw)
+
+	mm.wg.Add(1)
+	defer mm.wg.Done()
+
+	if err := mm.handshakeMasternodePeer(peer); err != nil {
+		log.Debug("Masternode handshake failed", "peer", peer.id, "err", err)
+		return err
+	}
+	if err := mm.mnPeers.Register(peer); err != nil {
+		log.Error("Masternode peer registration failed", "peer", peer.id, "err", err)
+		return err
+	}
+	defer mm.mnPeers.Unregister(peer.id)
+
+	log.Debug("Masternode peer connected", "peer", peer.id, "version", version)
+
+	for {
+		if err := mm.handleMasternodeMsg(peer); err != nil {
+			log.Debug("Masternode message handling failed", "peer", peer.id, "err", err)
+			return err
+		}
+	}
+}
+
+// handshakeMasternodePeer exchanges and validates the mnStatusData of both
+// ends of the connection, the masternode-protocol analogue of eth's
+// peer.Handshake.
+func (mm *MasternodeManager) handshakeMasternodePeer(p *mnPeer) error {
+	errc := make(chan error, 2)
+	var status mnStatusData
+
+	go func() {
+		errc <- p2p.Send(p.rw, MnStatusMsg, &mnStatusData{
+			ProtocolVersion: uint32(p.version),
+			NetworkId:       mm.networkId,
+			GenesisHash:     mm.blockchain.Genesis().Hash(),
+			MasternodeId:    mm.activeMasternodeId(),
+			Tier:            0,
+		})
+	}()
+	go func() {
+		errc <- p.readStatus(&status)
+	}()
+
+	timeout := time.NewTimer(mnHandshakeTimeout)
+	defer timeout.Stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if err != nil {
+				return err
+			}
+		case <-timeout.C:
+			return errMn(ErrMnNoStatusMsg, "timed out")
+		}
+	}
+
+	if status.NetworkId != mm.networkId {
+		return errMn(ErrMnNetworkIdMismatch, "%d (!= %d)", status.NetworkId, mm.networkId)
+	}
+	if status.GenesisHash != mm.blockchain.Genesis().Hash() {
+		return errMn(ErrMnGenesisBlockMismatch, "%x (!= %x)", status.GenesisHash, mm.blockchain.Genesis().Hash())
+	}
+	if status.ProtocolVersion != uint32(p.version) {
+		return errMn(ErrMnProtocolVersionMismatch, "%d (!= %d)", status.ProtocolVersion, p.version)
+	}
+
+	p.masternodeId = status.MasternodeId
+	p.tier = status.Tier
+	return nil
+}
+
+// readStatus reads and decodes the peer's status message. It is an error if
+// the first message received is not a status message; a status message that
+// arrives again after the handshake is rejected by handleMasternodeMsg.
+func (p *mnPeer) readStatus(status *mnStatusData) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if msg.Code != MnStatusMsg {
+		return errMn(ErrMnNoStatusMsg, "first msg has code %x (!= %x)", msg.Code, MnStatusMsg)
+	}
+	if msg.Size > MasternodeProtocolMaxMsgSize {
+		return errMn(ErrMnMsgTooLarge, "%v > %v", msg.Size, MasternodeProtocolMaxMsgSize)
+	}
+	if err := msg.Decode(status); err != nil {
+		return errMn(ErrMnDecode, "%v: %v", msg, err)
+	}
+	return nil
+}
+
+// activeMasternodeId returns the ID of the locally running masternode, or an
+// empty string if this node doesn't operate one.
+func (mm *MasternodeManager) activeMasternodeId() string {
+	if mm.active == nil {
+		return ""
+	}
+	return mm.active.ID
+}
+
+// NodeInfo retrieves some masternode-protocol metadata about the running
+// host node, exposed through p2p.Protocol.NodeInfo.
+func (mm *MasternodeManager) NodeInfo() *MasternodeNodeInfo {
+	return &MasternodeNodeInfo{
+		Network:      mm.networkId,
+		Genesis:      mm.blockchain.Genesis().Hash(),
+		MasternodeId: mm.activeMasternodeId(),
+	}
+}
+
+// handleMasternodeMsg is invoked whenever an inbound message is received from
+// a masternode-protocol peer. It dispatches purely on message code; decoding
+// and application of each payload (InstantSend lock request/vote, payment
+// vote, broadcast/announce) mirrors the eth protocol's own handleMsg, just
+// scoped to masternode traffic only. A ping is only logged; its payload is
+// not decoded.
+func (mm *MasternodeManager) handleMasternodeMsg(p *mnPeer) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if msg.Size > MasternodeProtocolMaxMsgSize {
+		return errMn(ErrMnMsgTooLarge, "%v > %v", msg.Size, MasternodeProtocolMaxMsgSize)
+	}
+	defer msg.Discard()
+
+	switch {
+	case msg.Code == MnStatusMsg:
+		return errMn(ErrMnExtraStatusMsg, "uncontrolled status message")
+
+	case msg.Code == MasternodePingMsg:
+		log.Trace("Masternode ping received", "peer", p.id)
+
+	case msg.Code == TxLockRequestMsg:
+		var tx types.Transaction
+		if err := msg.Decode(&tx); err != nil {
+			return errMn(ErrMnDecode, "%v: %v", msg, err)
+		}
+		mm.ProcessTxVote(&tx)
+
+	case msg.Code == TxLockVoteMsg:
+		var vote types.TxLockVote
+		if err := msg.Decode(&vote); err != nil {
+			return errMn(ErrMnDecode, "%v: %v", msg, err)
+		}
+		mm.ProcessTxLockVotes([]*types.TxLockVote{&vote})
+
+	case msg.Code == MasternodePaymentVoteMsg:
+		var vote MasternodePaymentVote
+		if err := msg.Decode(&vote); err != nil {
+			return errMn(ErrMnDecode, "%v: %v", msg, err)
+		}
+		mm.ProcessPaymentVotes(&vote)
+
+	case msg.Code == MasternodeBroadcastMsg || msg.Code == MasternodeAnnounceMsg:
+		var announce masternodeAnnounce
+		if err := msg.Decode(&announce); err != nil {
+			return errMn(ErrMnDecode, "%v: %v", msg, err)
+		}
+		if _, err := mm.masternodes.NodeJoin(announce.Id); err != nil {
+			log.Debug("Masternode announce rejected", "peer", p.id, "err", err)
+		}
+
+	default:
+		return errMn(ErrMnInvalidMsgCode, "%v", msg.Code)
+	}
+	return nil
+}
@@ -19,7 +19,6 @@ package eth
 
 import (
 	"fmt"
-	"math/big"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -38,9 +37,9 @@ import (
 	"github.com/ethzero/go-ethzero/log"
 	"github.com/ethzero/go-ethzero/masternode"
 	"github.com/ethzero/go-ethzero/p2p"
+	"github.com/ethzero/go-ethzero/p2p/discover"
 	"github.com/ethzero/go-ethzero/params"
 	"github.com/pkg/errors"
-	"net"
 )
 
 const (
@@ -60,6 +59,7 @@ type MasternodeManager struct {
 
 	fetcher *fetcher.Fetcher
 	peers   *peerSet
+	mnPeers *mnPeerSet
 
 	masternodes *masternode.MasternodeSet
 
@@ -70,6 +70,9 @@ type MasternodeManager struct {
 	winner *MasternodePayments
 
 	active *masternode.ActiveMasternode
+	syncer *masternodeSyncer
+
+	beacon BeaconSource
 
 	SubProtocols []p2p.Protocol
 
@@ -78,6 +81,9 @@ type MasternodeManager struct {
 	txSub         event.Subscription
 	minedBlockSub *event.TypeMuxSubscription
 
+	joinSub event.Subscription
+	quitSub event.Subscription
+
 	// channels for fetcher, syncer, txsyncLoop
 	newPeerCh   chan *peer
 	txsyncCh    chan *txsync
@@ -86,7 +92,8 @@ type MasternodeManager struct {
 
 	// wait group is used for graceful shutdowns during downloading
 	// and processing
-	wg sync.WaitGroup
+	wg       sync.WaitGroup
+	stopOnce sync.Once
 
 	log log.Logger
 
@@ -105,15 +112,41 @@ func NewMasternodeManager(config *params.ChainConfig, mode downloader.SyncMode,
 		blockchain:  blockchain,
 		chainconfig: config,
 		peers:       newPeerSet(),
+		mnPeers:     newMnPeerSet(),
+		beacon:      NullBeaconSource{},
 		newPeerCh:   make(chan *peer),
 		noMorePeers: make(chan struct{}),
 		txsyncCh:    make(chan *txsync),
 		quitSync:    make(chan struct{}),
 	}
+	manager.winner = NewMasternodePayments(manager)
+
+	manager.SubProtocols = make([]p2p.Protocol, 0, len(MasternodeProtocolVersions))
+	for i, version := range MasternodeProtocolVersions {
+		version := version // Closure
+
+		manager.SubProtocols = append(manager.SubProtocols, p2p.Protocol{
+			Name:    MasternodeProtocolName,
+			Version: version,
+			Length:  MasternodeProtocolLengths[i],
+			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+				return manager.runMasternodePeer(version, p, rw)
+			},
+			NodeInfo: func() interface{} {
+				return manager.NodeInfo()
+			},
+			PeerInfo: func(id discover.NodeID) interface{} {
+				if p := manager.mnPeers.Peer(fmt.Sprintf("%x", id[:8])); p != nil {
+					return p.Info()
+				}
+				return nil
+			},
+		})
+	}
+	if len(manager.SubProtocols) == 0 {
+		return nil, errIncompatibleConfig
+	}
 
-	//if len(manager.SubProtocols) == 0 {
-	//	return nil, errIncompatibleConfig
-	//}
 	validator := func(header *types.Header) error {
 		return engine.VerifyHeader(blockchain, header, true)
 	}
@@ -140,6 +173,15 @@ func NewMasternodeManager(config *params.ChainConfig, mode downloader.SyncMode,
 	return manager, nil
 }
 
+// SetBeaconSource selects the BeaconSource mixed into masternode selection
+// scoring. It is the config knob for switching between NullBeaconSource
+// (the pre-beacon default) and a real beacon such as ChainedBeaconSource,
+// and must be called before Start for the choice to apply to the initial
+// payment queue computation.
+func (mm *MasternodeManager) SetBeaconSource(beacon BeaconSource) {
+	mm.beacon = beacon
+}
+
 func (mm *MasternodeManager) removePeer(id string) {
 	// Short circuit if the peer was already removed
 	peer := mm.peers.Peer(id)
@@ -169,90 +211,165 @@ func (mm *MasternodeManager) Start(srvr *p2p.Server, contract *contract.Contract
 
 	mm.active = masternode.NewActiveMasternode(srvr)
 
-	go mm.masternodeLoop()
+	mm.syncer = newMasternodeSyncer(mm)
+	mm.wg.Add(1)
+	go mm.syncer.start()
+
+	// Block until the syncer has watched the contract, computed the initial
+	// active-masternode state and shown the loaded masternode set, so callers
+	// of Start observe a fully initialised manager. If a contract watch cannot
+	// be set up, the syncer returns without computing that state and Start
+	// returns as well.
+	<-mm.syncer.initDone
 }
 
+// Stop terminates the masternode manager's background loops and blocks until
+// every one of them (and every registered peer) has torn down. Stop is
+// idempotent: calling it more than once is a no-op after the first call.
 func (mm *MasternodeManager) Stop() {
+	mm.stopOnce.Do(func() {
+		log.Info("Stopping Etherzero masternode protocol")
+
+		if mm.joinSub != nil {
+			mm.joinSub.Unsubscribe() // quits the syncer's join watch
+		}
+		if mm.quitSub != nil {
+			mm.quitSub.Unsubscribe() // quits the syncer's quit watch
+		}
+
+		// Stop admitting new masternode-protocol peers; newPeer and
+		// runMasternodePeer both refuse once this is closed.
+		close(mm.noMorePeers)
+
+		// Disconnect existing sessions.
+		// This also closes the gate for any new registrations on the peer set.
+		// sessions which are already established but not added to mm.peers yet
+		// will exit when they try to register.
+		mm.peers.Close()
+		mm.mnPeers.Close()
+
+		// Wait for all peer handler goroutines and the loops to come down.
+		close(mm.quitSync)
+		mm.wg.Wait()
 
+		log.Info("Etherzero masternode protocol stopped")
+	})
 }
 
+// newPeer refuses to hand back a peer once shutdown has begun, so that
+// callers never register a peer with a manager that is already tearing down.
 func (mm *MasternodeManager) newPeer(pv int, p *p2p.Peer, rw p2p.MsgReadWriter) *peer {
-	return newPeer(pv, p, newMeteredMsgWriter(rw))
+	select {
+	case <-mm.noMorePeers:
+		return nil
+	case <-mm.quitSync:
+		return nil
+	default:
+		return newPeer(pv, p, newMeteredMsgWriter(rw))
+	}
 }
 
 // Deterministically select the oldest/best masternode to pay on the network
 // Pass in the hash value of the block that participates in the calculation.
 // Dash is the Hash passed to the first 100 blocks.
 // If use the current block Hash, there is a risk that the current block will be discarded.
+//
+// The winner is derived from the very same masternodeRankList that backs
+// GetMasternodeRank and MasternodeRankProof, instead of an independent
+// scoring pass, so the payment queue and the Merkle-committed rank list any
+// peer can verify can never disagree about who won.
 func (mm *MasternodeManager) GetNextMasternodeInQueueForPayment(block common.Hash) (*masternode.Masternode, error) {
-
-	var (
-		paids        []int
-		tenthNetWork = mm.masternodes.Len() / 10
-		countTenth   = 0
-		highest      *big.Int
-		winner       *masternode.Masternode
-		sortMap      map[int]*masternode.Masternode
-	)
 	if mm.masternodes == nil {
 		return nil, errors.New("no masternode detected")
 	}
-	for _, node := range mm.masternodes.Nodes() {
-		i := int(node.Height.Int64())
-		paids = append(paids, i)
-		sortMap[i] = node
-	}
 
-	sort.Ints(paids)
+	nodes := mm.masternodes.Nodes()
+	tenthNetWork := mm.masternodes.Len() / 10
+	if tenthNetWork < 1 {
+		tenthNetWork = 1
+	}
 
-	for _, i := range paids {
-		fmt.Printf("%s\t%d\n", i, sortMap[i].CalculateScore(block))
-		score := sortMap[i].CalculateScore(block)
-		if score.Cmp(highest) > 0 {
-			highest = score
-			winner = sortMap[i]
-		}
-		countTenth++
-		if countTenth >= tenthNetWork {
-			break
+	// Eligible candidates are the tenthNetWork nodes that have gone longest
+	// without being paid, i.e. the lowest Height.
+	byHeight := make([]*masternode.Masternode, len(nodes))
+	copy(byHeight, nodes)
+	sort.SliceStable(byHeight, func(i, j int) bool {
+		if c := byHeight[i].Height.Cmp(byHeight[j].Height); c != 0 {
+			return c < 0
 		}
+		return bytes.Compare([]byte(byHeight[i].ID), []byte(byHeight[j].ID)) < 0
+	})
+	if len(byHeight) > tenthNetWork {
+		byHeight = byHeight[:tenthNetWork]
+	}
+	eligible := make(map[string]bool, len(byHeight))
+	for _, node := range byHeight {
+		eligible[node.ID] = true
+	}
+	byID := make(map[string]*masternode.Masternode, len(nodes))
+	for _, node := range nodes {
+		byID[node.ID] = node
 	}
 
-	return winner, nil
+	// Walk the rank list highest score first and take the first eligible
+	// candidate, so the winner is always consistent with rank #1 among
+	// eligible nodes as reported by GetMasternodeRank.
+	list := newMasternodeRankList(mm.masternodeRankEntries(block))
+	for _, entry := range list.entries {
+		if eligible[entry.id] {
+			return byID[entry.id], nil
+		}
+	}
+	return nil, nil
 }
 
-func (mm *MasternodeManager) GetMasternodeRank(id string) (int, bool) {
-
-	var rank int = 0
-	mm.syncer()
-	block := mm.blockchain.CurrentBlock()
-
-	if block == nil {
-		mm.log.Info("ERROR: GetBlockHash() failed at BlockHeight:%d ", block.Number())
-		return rank, false
-	}
-	masternodeScores := mm.GetMasternodeScores(block.Hash(), 1)
-
-	tRank := 0
-	for _, masternode := range masternodeScores {
-		//info := MasternodeInfo()
-		tRank++
-		if id == masternode.ID {
-			rank = tRank
-			break
-		}
+// masternodeRankEntries builds the (id, score) pairs that back the
+// Merkle-committed rank list for blockHash, one per currently known
+// masternode.
+func (mm *MasternodeManager) masternodeRankEntries(blockHash common.Hash) []rankEntry {
+	nodes := mm.masternodes.Nodes()
+	entries := make([]rankEntry, 0, len(nodes))
+	for _, m := range nodes {
+		entries = append(entries, rankEntry{id: m.ID, score: mm.scoreFor(m, blockHash)})
 	}
-	return rank, true
+	return entries
 }
 
-func (mm *MasternodeManager) GetMasternodeScores(blockHash common.Hash, minProtocol int) map[*big.Int]*masternode.Masternode {
+// MasternodeRankRoot returns the Merkle root committing to the ordered
+// (masternodeID, score) rank list for the given block, so it can be carried
+// in the block header extra-data or a masternode-vote payload and checked by
+// any peer without it holding the full masternode set.
+func (mm *MasternodeManager) MasternodeRankRoot(blockHash common.Hash) (common.Hash, error) {
+	if mm.masternodes == nil {
+		return common.Hash{}, errors.New("no masternode detected")
+	}
+	list := newMasternodeRankList(mm.masternodeRankEntries(blockHash))
+	return list.Root(), nil
+}
 
-	masternodeScores := make(map[*big.Int]*masternode.Masternode)
+// MasternodeRankProof returns a Merkle proof that id occupies its claimed
+// rank within the current masternode set for blockHash.
+func (mm *MasternodeManager) MasternodeRankProof(blockHash common.Hash, id string) ([][]byte, int, error) {
+	if mm.masternodes == nil {
+		return nil, 0, errors.New("no masternode detected")
+	}
+	list := newMasternodeRankList(mm.masternodeRankEntries(blockHash))
+	return list.Proof(id)
+}
 
-	for _, m := range mm.masternodes.Nodes() {
-		masternodeScores[m.CalculateScore(blockHash)] = m
+// GetMasternodeRank returns id's 1-based position in the Merkle-committed
+// rank list for the current block, highest score first.
+func (mm *MasternodeManager) GetMasternodeRank(id string) (int, bool) {
+	if mm.masternodes == nil {
+		return 0, false
+	}
+	block := mm.blockchain.CurrentBlock()
+	if block == nil {
+		log.Error("GetMasternodeRank: current block unavailable")
+		return 0, false
 	}
-	return masternodeScores
+	list := newMasternodeRankList(mm.masternodeRankEntries(block.Hash()))
+	return list.Rank(id)
 }
 
 func (mm *MasternodeManager) ProcessTxLockVotes(votes []*types.TxLockVote) bool {
@@ -269,8 +386,15 @@ func (mm *MasternodeManager) ProcessTxLockVotes(votes []*types.TxLockVote) bool
 	return mm.is.ProcessTxLockVotes(votes)
 }
 
+// ProcessPaymentVotes applies an incoming masternode payment vote, first
+// rejecting it if it references a beacon round this node cannot verify -
+// either because the round is still in the future or because its entry
+// doesn't chain from the previous round under the active BeaconSource.
 func (mm *MasternodeManager) ProcessPaymentVotes(vote *MasternodePaymentVote) bool {
-
+	if err := mm.ValidateBeaconRound(vote.BlockHash, vote.BeaconRound, vote.BeaconPrevEntry, vote.BeaconEntry); err != nil {
+		log.Debug("ProcessPaymentVotes: rejecting vote with unverifiable beacon round", "err", err)
+		return false
+	}
 	return mm.winner.Vote(vote)
 }
 
@@ -302,84 +426,19 @@ func (mn *MasternodeManager) updateActiveMasternode() {
 	
 	mn.active.SetState(state)
 }
-func (mn *MasternodeManager) masternodeLoop() {
-	mn.updateActiveMasternode()
-	if mn.active.State() == masternode.ACTIVE_MASTERNODE_STARTED {
-		fmt.Println("masternodeCheck true")
-	} else if !mn.srvr.MasternodeAddr.IP.Equal(net.IP{}) {
-		var misc [32]byte
-		misc[0] = 1
-		copy(misc[1:17], mn.srvr.Config.MasternodeAddr.IP)
-		binary.BigEndian.PutUint16(misc[17:19], uint16(mn.srvr.Config.MasternodeAddr.Port))
-
-		var buf bytes.Buffer
-		buf.Write(mn.srvr.Self().ID[:])
-		buf.Write(misc[:])
-		d := "0x4da274fd" + common.Bytes2Hex(buf.Bytes())
-		fmt.Println("Masternode transaction data:", d)
-	}
 
-	mn.masternodes.Show()
-
-	joinCh := make(chan *contract.ContractJoin, 32)
-	quitCh := make(chan *contract.ContractQuit, 32)
-	joinSub, err1 := mn.contract.WatchJoin(nil, joinCh)
-	if err1 != nil {
-		// TODO: exit
-		return
-	}
-	quitSub, err2 := mn.contract.WatchQuit(nil, quitCh)
-	if err2 != nil {
-		// TODO: exit
-		return
-	}
-
-	//pingMsg := &masternode.PingMsg{
-	//	ID: self.node.ID,
-	//	IP: self.node.IP,
-	//	Port: self.node.TCP,
-	//}
-	//t := time.NewTimer(time.Second * 5)
-
-	for {
-		select {
-		case join := <-joinCh:
-			fmt.Println("join", common.Bytes2Hex(join.Id[:]))
-			node, err := mn.masternodes.NodeJoin(join.Id)
-			if err == nil {
-				if bytes.Equal(join.Id[:], mn.srvr.Self().ID[0:32]) {
-					mn.updateActiveMasternode()
-				} else {
-					mn.srvr.AddPeer(node.Node)
-				}
-				mn.masternodes.Show()
-			}
-
-		case quit := <-quitCh:
-			fmt.Println("quit", common.Bytes2Hex(quit.Id[:]))
-			mn.masternodes.NodeQuit(quit.Id)
-			if bytes.Equal(quit.Id[:], mn.srvr.Self().ID[0:32]) {
-				mn.updateActiveMasternode()
-			}
-			mn.masternodes.Show()
-
-		case err := <-joinSub.Err():
-			joinSub.Unsubscribe()
-			fmt.Println("eventJoin err", err.Error())
-		case err := <-quitSub.Err():
-			quitSub.Unsubscribe()
-			fmt.Println("eventQuit err", err.Error())
-
-			//case <-t.C:
-			//	pingMsg.Update(self.privateKey)
-			//	peers := self.peers.peers
-			//	for _, peer := range peers {
-			//		fmt.Println("peer", peer.ID())
-			//		if err := peer.SendMasternodePing(pingMsg); err != nil {
-			//			fmt.Println("err:", err)
-			//		}
-			//	}
-			//	t.Reset(time.Second * 100)
-		}
-	}
+// registrationTxData builds the calldata for the on-chain transaction that
+// (re-)registers this node's masternode address, used by the syncer whenever
+// it notices the active masternode isn't started yet but a masternode
+// address has been configured.
+func (mn *MasternodeManager) registrationTxData() string {
+	var misc [32]byte
+	misc[0] = 1
+	copy(misc[1:17], mn.srvr.Config.MasternodeAddr.IP)
+	binary.BigEndian.PutUint16(misc[17:19], uint16(mn.srvr.Config.MasternodeAddr.Port))
+
+	var buf bytes.Buffer
+	buf.Write(mn.srvr.Self().ID[:])
+	buf.Write(misc[:])
+	return "0x4da274fd" + common.Bytes2Hex(buf.Bytes())
 }
@@ -0,0 +1,122 @@
+// Copyright 2018 The go-etherzero Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ethzero/go-ethzero/common"
+	"github.com/ethzero/go-ethzero/core/types"
+	"github.com/ethzero/go-ethzero/masternode"
+)
+
+// MasternodePaymentVote is one masternode's vote for the winner of
+// BlockHash's payment. All fields are plain RLP-encodable types (no custom
+// EncodeRLP/DecodeRLP is needed), so it round-trips through p2p.Send and
+// msg.Decode exactly like any other wire message in this package.
+//
+// BeaconRound/BeaconPrevEntry/BeaconEntry record the beacon round the voter
+// scored masternodes against, together with the chain entries needed to
+// verify it, so a receiving peer can validate the vote - via
+// MasternodeManager.ValidateBeaconRound - without needing the beacon's
+// signing key.
+type MasternodePaymentVote struct {
+	BlockHash    common.Hash
+	MasternodeId string
+	WinnerId     string
+
+	BeaconRound     uint64
+	BeaconPrevEntry []byte
+	BeaconEntry     []byte
+
+	Signature []byte
+}
+
+// NewMasternodePaymentVote builds and stamps a payment vote for winner on
+// blockHash with the beacon round (and the chain entries needed to verify
+// it) active at the time of voting.
+func (mm *MasternodeManager) NewMasternodePaymentVote(blockHash common.Hash, winner *masternode.Masternode) (*MasternodePaymentVote, error) {
+	vote := &MasternodePaymentVote{
+		BlockHash:    blockHash,
+		MasternodeId: mm.activeMasternodeId(),
+		WinnerId:     winner.ID,
+	}
+
+	if _, ok := mm.beacon.(NullBeaconSource); ok || mm.beacon == nil {
+		return vote, nil
+	}
+
+	round := mm.beaconRound(blockHash)
+	entry, err := mm.beacon.Entry(context.Background(), round)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := chainedBeaconGenesis
+	if round > 0 {
+		prev, err = mm.beacon.Entry(context.Background(), round-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vote.BeaconRound = round
+	vote.BeaconPrevEntry = prev
+	vote.BeaconEntry = entry
+	return vote, nil
+}
+
+// MasternodePayments tracks, per block, the payment votes cast by
+// masternodes. It only records the votes; it does not tally them or
+// determine a winner from them.
+type MasternodePayments struct {
+	mm *MasternodeManager
+
+	mu    sync.Mutex
+	votes map[common.Hash][]*MasternodePaymentVote
+}
+
+// NewMasternodePayments returns an empty MasternodePayments bound to mm.
+func NewMasternodePayments(mm *MasternodeManager) *MasternodePayments {
+	return &MasternodePayments{
+		mm:    mm,
+		votes: make(map[common.Hash][]*MasternodePaymentVote),
+	}
+}
+
+// Vote records vote, rejecting a second vote from the same masternode for
+// the same block.
+func (mp *MasternodePayments) Vote(vote *MasternodePaymentVote) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, v := range mp.votes[vote.BlockHash] {
+		if v.MasternodeId == vote.MasternodeId {
+			return false
+		}
+	}
+	mp.votes[vote.BlockHash] = append(mp.votes[vote.BlockHash], vote)
+	return true
+}
+
+// ProcessBlock is the fetcher's vote callback, invoked before a freshly
+// received block is accepted; it always accepts today, pending full
+// payment-vote quorum checking against mp.votes.
+func (mp *MasternodePayments) ProcessBlock(block *types.Block) bool {
+	return true
+}
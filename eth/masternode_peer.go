@@ -0,0 +1,154 @@
+// Copyright 2015 The go-ethereum Authors
+// Copyright 2018 The go-etherzero Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ethzero/go-ethzero/p2p"
+)
+
+// mnPeer wraps a p2p.Peer that has successfully completed the masternode
+// handshake. It carries the masternode-specific capabilities advertised at
+// handshake time, separately from whatever eth peer (if any) is layered over
+// the same connection.
+type mnPeer struct {
+	id string
+
+	*p2p.Peer
+	rw p2p.MsgReadWriter
+
+	version uint32 // Protocol version negotiated
+
+	masternodeId string // Active masternode ID announced by the remote side, empty if none
+	tier         uint32 // Masternode tier announced by the remote side
+}
+
+func newMnPeer(version uint32, p *p2p.Peer, rw p2p.MsgReadWriter) *mnPeer {
+	return &mnPeer{
+		Peer:    p,
+		rw:      rw,
+		version: version,
+		id:      fmt.Sprintf("%x", p.ID().Bytes()[:8]),
+	}
+}
+
+// Info gathers and returns a collection of metadata known about a masternode
+// peer, for diagnostic purposes (p2p.Protocol.PeerInfo).
+func (p *mnPeer) Info() *mnPeerInfo {
+	return &mnPeerInfo{
+		Version:      p.version,
+		MasternodeId: p.masternodeId,
+		Tier:         p.tier,
+	}
+}
+
+// mnPeerInfo represents a short summary of the masternode sub-protocol
+// metadata known about a connected peer.
+type mnPeerInfo struct {
+	Version      uint32 `json:"version"`      // Masternode protocol version negotiated
+	MasternodeId string `json:"masternodeId"` // Active masternode ID advertised by the peer, if any
+	Tier         uint32 `json:"tier"`         // Masternode tier advertised by the peer
+}
+
+// mnPeerSet represents the collection of active masternode-protocol peers,
+// kept deliberately separate from the eth peerSet so that masternode gossip
+// never leaks to peers that only speak eth.
+type mnPeerSet struct {
+	peers  map[string]*mnPeer
+	lock   sync.RWMutex
+	closed bool
+}
+
+func newMnPeerSet() *mnPeerSet {
+	return &mnPeerSet{
+		peers: make(map[string]*mnPeer),
+	}
+}
+
+// Register injects a new masternode peer into the working set, or returns an
+// error if the peer is already known or the set is closed.
+func (ps *mnPeerSet) Register(p *mnPeer) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if ps.closed {
+		return errMnPeerNotRegistered
+	}
+	if _, ok := ps.peers[p.id]; ok {
+		return errAlreadyRegistered
+	}
+	ps.peers[p.id] = p
+	return nil
+}
+
+// Unregister removes a masternode peer from the active set, returning an
+// error if the peer is unknown.
+func (ps *mnPeerSet) Unregister(id string) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if _, ok := ps.peers[id]; !ok {
+		return errMnPeerNotRegistered
+	}
+	delete(ps.peers, id)
+	return nil
+}
+
+// Peer retrieves the masternode peer with the given id, or nil if it is not
+// currently registered.
+func (ps *mnPeerSet) Peer(id string) *mnPeer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return ps.peers[id]
+}
+
+// peersSnapshot returns a point-in-time copy of the registered masternode
+// peers, safe to range over without holding the set's lock.
+func (ps *mnPeerSet) peersSnapshot() []*mnPeer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	list := make([]*mnPeer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		list = append(list, p)
+	}
+	return list
+}
+
+// Len returns the number of masternode peers currently registered.
+func (ps *mnPeerSet) Len() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(ps.peers)
+}
+
+// Close disconnects all masternode peers and marks the set closed so no
+// further registrations are accepted.
+func (ps *mnPeerSet) Close() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	for _, p := range ps.peers {
+		p.Disconnect(p2p.DiscQuitting)
+	}
+	ps.closed = true
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 The go-ethereum Authors
+// Copyright 2018 The go-etherzero Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethzero/go-ethzero/common"
+)
+
+// Masternode sub-protocol: carries masternode-specific gossip (pings,
+// InstantSend lock requests/votes, payment votes, broadcast/announce) that
+// used to be smuggled over the eth wire protocol. Keeping it separate means a
+// node that never runs a masternode doesn't have to see, decode or validate
+// any of this traffic.
+const (
+	mn1 = 1
+)
+
+// MasternodeProtocolName is the official short name of the masternode
+// protocol used during capability negotiation.
+const MasternodeProtocolName = "mn"
+
+// MasternodeProtocolVersions are the supported versions of the masternode
+// protocol (first is primary).
+var MasternodeProtocolVersions = []uint{mn1}
+
+// MasternodeProtocolLengths are the number of implemented message codes for
+// each of the supported masternode protocol versions.
+var MasternodeProtocolLengths = []uint64{7}
+
+const MasternodeProtocolMaxMsgSize = 10 * 1024 * 1024 // Maximum cap on the size of a protocol message
+
+// masternode protocol message codes
+const (
+	MnStatusMsg              = 0x00
+	MasternodePingMsg        = 0x01
+	TxLockRequestMsg         = 0x02
+	TxLockVoteMsg            = 0x03
+	MasternodePaymentVoteMsg = 0x04
+	MasternodeBroadcastMsg   = 0x05
+	MasternodeAnnounceMsg    = 0x06
+)
+
+type mnErrCode int
+
+const (
+	ErrMnMsgTooLarge = iota
+	ErrMnDecode
+	ErrMnInvalidMsgCode
+	ErrMnProtocolVersionMismatch
+	ErrMnNetworkIdMismatch
+	ErrMnGenesisBlockMismatch
+	ErrMnNoStatusMsg
+	ErrMnExtraStatusMsg
+)
+
+func (e mnErrCode) String() string {
+	return mnErrorToString[int(e)]
+}
+
+var mnErrorToString = map[int]string{
+	ErrMnMsgTooLarge:             "Message too long",
+	ErrMnDecode:                  "Invalid message",
+	ErrMnInvalidMsgCode:          "Invalid message code",
+	ErrMnProtocolVersionMismatch: "Protocol version mismatch",
+	ErrMnNetworkIdMismatch:       "NetworkId mismatch",
+	ErrMnGenesisBlockMismatch:    "Genesis block mismatch",
+	ErrMnNoStatusMsg:             "No status message",
+	ErrMnExtraStatusMsg:          "Extra status message",
+}
+
+type mnError struct {
+	code    int
+	message string
+}
+
+func errMn(code int, format string, v ...interface{}) *mnError {
+	return &mnError{code, fmt.Sprintf(format, v...)}
+}
+
+func (e *mnError) Error() string {
+	return e.message
+}
+
+var errMnPeerNotRegistered = errors.New("masternode peer not registered")
+
+// errIncompatibleConfig is returned by NewMasternodeManager when
+// MasternodeProtocolVersions lists no masternode protocol version.
+var errIncompatibleConfig = errors.New("incompatible configuration")
+
+// MasternodeNodeInfo represents a small collection of masternode-protocol
+// metadata known about the host peer, exposed via p2p.Protocol.NodeInfo.
+type MasternodeNodeInfo struct {
+	Network      uint64      `json:"network"`      // Ethzero network ID
+	Genesis      common.Hash `json:"genesis"`       // SHA3 hash of the host's genesis block
+	MasternodeId string      `json:"masternodeId"` // Active masternode ID of the host, if any
+}
+
+// mnStatusData is the network handshake for the masternode protocol. In
+// addition to the usual network/genesis checks it carries the sender's
+// active masternode ID (empty if it isn't running one) and tier, so a peer
+// can immediately tell whether the other side participates in masternode
+// gossip at all.
+type mnStatusData struct {
+	ProtocolVersion uint32
+	NetworkId       uint64
+	GenesisHash     common.Hash
+	MasternodeId    string
+	Tier            uint32
+}
+
+// masternodeAnnounce carries the ID of a masternode that either just
+// registered on-chain (MasternodeBroadcastMsg) or is being re-announced by a
+// gossiping peer (MasternodeAnnounceMsg), so the receiver can look it up
+// through the same masternodes.NodeJoin path used for contract Join events.
+type masternodeAnnounce struct {
+	Id [32]byte
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 The go-ethereum Authors
+// Copyright 2018 The go-etherzero Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethzero/go-ethzero/common"
+	"github.com/ethzero/go-ethzero/crypto"
+)
+
+// rankEntry is a single (masternodeID, score) pair contributing a leaf to a
+// masternodeRankList.
+type rankEntry struct {
+	id    string
+	score *big.Int
+}
+
+// masternodeRankList is a deterministic, Merkle-committed ordering of
+// masternodes by score. Building it is cheap and side-effect free, so it is
+// reconstructed on demand from the live masternode set rather than cached;
+// any peer that agrees on the set of (id, score) pairs for a block
+// reconstructs byte-for-byte the same tree and root.
+type masternodeRankList struct {
+	entries []rankEntry // sorted highest score first, ties broken by id
+	tree    [][][]byte  // tree[0] is the leaf layer, tree[len-1] the root layer
+}
+
+// newMasternodeRankList sorts entries by descending score (ties broken by
+// masternode ID bytes, so the ordering never depends on map/slice iteration
+// order) and builds the Merkle tree over the resulting leaves.
+func newMasternodeRankList(entries []rankEntry) *masternodeRankList {
+	sorted := make([]rankEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := sorted[i].score.Cmp(sorted[j].score); c != 0 {
+			return c > 0
+		}
+		return bytes.Compare([]byte(sorted[i].id), []byte(sorted[j].id)) < 0
+	})
+
+	leaves := make([][]byte, len(sorted))
+	for i, e := range sorted {
+		leaves[i] = masternodeRankLeaf(e.id, e.score)
+	}
+	return &masternodeRankList{entries: sorted, tree: buildMerkleTree(leaves)}
+}
+
+// masternodeRankLeaf is the leaf hash committed to for a given masternode:
+// keccak256(id || score), score left-padded to 32 bytes.
+func masternodeRankLeaf(id string, score *big.Int) []byte {
+	buf := make([]byte, 0, len(id)+32)
+	buf = append(buf, []byte(id)...)
+	buf = append(buf, common.LeftPadBytes(score.Bytes(), 32)...)
+	return crypto.Keccak256(buf)
+}
+
+// buildMerkleTree returns every layer of the binary Merkle tree over leaves,
+// from the leaves themselves up to a single-element root layer. An odd node
+// out at any layer is paired with itself, matching Bitcoin/Dash-style Merkle
+// trees.
+func buildMerkleTree(leaves [][]byte) [][][]byte {
+	if len(leaves) == 0 {
+		return [][][]byte{{common.Hash{}.Bytes()}}
+	}
+
+	tree := [][][]byte{leaves}
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, hashMerklePair(level[i], level[i]))
+			} else {
+				next = append(next, hashMerklePair(level[i], level[i+1]))
+			}
+		}
+		tree = append(tree, next)
+		level = next
+	}
+	return tree
+}
+
+func hashMerklePair(left, right []byte) []byte {
+	buf := make([]byte, 0, len(left)+len(right))
+	buf = append(buf, left...)
+	buf = append(buf, right...)
+	return crypto.Keccak256(buf)
+}
+
+// Root returns the Merkle root committing to the whole rank list.
+func (l *masternodeRankList) Root() common.Hash {
+	return common.BytesToHash(l.tree[len(l.tree)-1][0])
+}
+
+// Rank returns id's 1-based position in the list, highest score first, and
+// whether id was found at all.
+func (l *masternodeRankList) Rank(id string) (int, bool) {
+	for i, e := range l.entries {
+		if e.id == id {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// Proof returns the sibling hashes from id's leaf up to the root, along with
+// the leaf's index, so that a peer holding only the root can verify id's
+// rank via VerifyMasternodeRankProof.
+func (l *masternodeRankList) Proof(id string) ([][]byte, int, error) {
+	rank, ok := l.Rank(id)
+	if !ok {
+		return nil, 0, fmt.Errorf("masternode %s not present in rank list", id)
+	}
+
+	index := rank - 1
+	proof := make([][]byte, 0, len(l.tree)-1)
+	for _, level := range l.tree[:len(l.tree)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		proof = append(proof, level[sibling])
+		index /= 2
+	}
+	return proof, rank - 1, nil
+}
+
+// VerifyMasternodeRankProof recomputes the Merkle path for (id, score) at
+// index against proof and reports whether it reproduces root.
+func VerifyMasternodeRankProof(root common.Hash, id string, score *big.Int, index int, proof [][]byte) bool {
+	computed := masternodeRankLeaf(id, score)
+	for _, sibling := range proof {
+		if index%2 == 0 {
+			computed = hashMerklePair(computed, sibling)
+		} else {
+			computed = hashMerklePair(sibling, computed)
+		}
+		index /= 2
+	}
+	return common.BytesToHash(computed) == root
+}
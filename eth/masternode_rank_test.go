@@ -0,0 +1,85 @@
+// Copyright 2018 The go-etherzero Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestMasternodeRankListProofRoundTrip(t *testing.T) {
+	entries := []rankEntry{
+		{id: "mn-a", score: big.NewInt(50)},
+		{id: "mn-b", score: big.NewInt(90)},
+		{id: "mn-c", score: big.NewInt(10)},
+		{id: "mn-d", score: big.NewInt(70)},
+		{id: "mn-e", score: big.NewInt(30)},
+	}
+	list := newMasternodeRankList(entries)
+	root := list.Root()
+
+	for _, e := range entries {
+		proof, index, err := list.Proof(e.id)
+		if err != nil {
+			t.Fatalf("Proof(%s) failed: %v", e.id, err)
+		}
+		if !VerifyMasternodeRankProof(root, e.id, e.score, index, proof) {
+			t.Errorf("VerifyMasternodeRankProof(%s) = false, want true", e.id)
+		}
+		if VerifyMasternodeRankProof(root, e.id, big.NewInt(e.score.Int64()+1), index, proof) {
+			t.Errorf("VerifyMasternodeRankProof(%s) with tampered score = true, want false", e.id)
+		}
+	}
+
+	if _, _, err := list.Proof("mn-missing"); err == nil {
+		t.Error("Proof(mn-missing) succeeded, want error")
+	}
+}
+
+func TestMasternodeRankListTieBreakByID(t *testing.T) {
+	entries := []rankEntry{
+		{id: "mn-z", score: big.NewInt(100)},
+		{id: "mn-a", score: big.NewInt(100)},
+		{id: "mn-m", score: big.NewInt(100)},
+	}
+
+	wantOrder := []string{"mn-a", "mn-m", "mn-z"}
+	for i := 0; i < 5; i++ {
+		list := newMasternodeRankList(entries)
+		for i, id := range wantOrder {
+			rank, ok := list.Rank(id)
+			if !ok || rank != i+1 {
+				t.Fatalf("Rank(%s) = %d, %v; want %d, true", id, rank, ok, i+1)
+			}
+		}
+	}
+}
+
+func TestMasternodeRankListStableAcrossInputOrder(t *testing.T) {
+	a := []rankEntry{
+		{id: "mn-1", score: big.NewInt(5)},
+		{id: "mn-2", score: big.NewInt(20)},
+		{id: "mn-3", score: big.NewInt(15)},
+	}
+	b := []rankEntry{a[2], a[0], a[1]}
+
+	rootA := newMasternodeRankList(a).Root()
+	rootB := newMasternodeRankList(b).Root()
+	if rootA != rootB {
+		t.Errorf("root depends on input order: %x != %x", rootA, rootB)
+	}
+}
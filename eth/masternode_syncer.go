@@ -0,0 +1,267 @@
+// Copyright 2015 The go-ethereum Authors
+// Copyright 2018 The go-etherzero Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/ethzero/go-ethzero/common"
+	"github.com/ethzero/go-ethzero/contracts/masternode/contract"
+	"github.com/ethzero/go-ethzero/core"
+	"github.com/ethzero/go-ethzero/log"
+	"github.com/ethzero/go-ethzero/masternode"
+	"github.com/ethzero/go-ethzero/p2p"
+)
+
+// masternodePingInterval is how often a started masternode re-announces
+// itself to connected peers, independent of Join/Quit contract events.
+const masternodePingInterval = 5 * time.Minute
+
+// mnSyncState is the masternode syncer's own view of this node's
+// participation in the network, distinct from (but derived from)
+// masternode.ActiveMasternode's state.
+type mnSyncState int
+
+const (
+	mnSyncNotCapable mnSyncState = iota // no masternode address configured
+	mnSyncSyncing                       // a masternode is configured but not yet confirmed started
+	mnSyncStarted                       // the local masternode is registered and confirmed reachable
+	mnSyncExpired                       // the local masternode just quit or was evicted from the chain
+)
+
+func (s mnSyncState) String() string {
+	switch s {
+	case mnSyncNotCapable:
+		return "NotCapable"
+	case mnSyncSyncing:
+		return "Syncing"
+	case mnSyncStarted:
+		return "Started"
+	case mnSyncExpired:
+		return "Expired"
+	default:
+		return "unknown"
+	}
+}
+
+// masternodeSyncer owns the masternode manager's single background control
+// loop. It is the masternode-side analogue of eth's rewritten chainSyncer:
+// every external trigger that can change this node's masternode state or
+// requires re-evaluating it - contract Join/Quit events, new chain heads,
+// pending transactions, periodic re-registration and shutdown - is funneled
+// through one select loop instead of being handled ad hoc.
+type masternodeSyncer struct {
+	mm    *MasternodeManager
+	state mnSyncState
+
+	// initDone is closed once the contract watches are established and the
+	// initial masternode state has been computed, so Start can block until
+	// the manager is in a consistent state. It is also closed, without that
+	// state being computed, when either contract watch fails to be set up.
+	initDone chan struct{}
+}
+
+func newMasternodeSyncer(mm *MasternodeManager) *masternodeSyncer {
+	return &masternodeSyncer{
+		mm:       mm,
+		state:    mnSyncNotCapable,
+		initDone: make(chan struct{}),
+	}
+}
+
+// start runs the syncer's control loop. It returns when the manager shuts
+// down or either contract watch dies, and must be launched with
+// mm.wg.Add(1) already accounted for.
+func (s *masternodeSyncer) start() {
+	mm := s.mm
+	defer mm.wg.Done()
+
+	joinCh := make(chan *contract.ContractJoin, 32)
+	quitCh := make(chan *contract.ContractQuit, 32)
+
+	joinSub, err := mm.contract.WatchJoin(nil, joinCh)
+	if err != nil {
+		log.Error("masternodeSyncer: WatchJoin failed", "err", err)
+		close(s.initDone)
+		return
+	}
+	mm.joinSub = joinSub
+
+	quitSub, err := mm.contract.WatchQuit(nil, quitCh)
+	if err != nil {
+		log.Error("masternodeSyncer: WatchQuit failed", "err", err)
+		close(s.initDone)
+		return
+	}
+	mm.quitSub = quitSub
+
+	chainHeadCh := make(chan core.ChainHeadEvent, 10)
+	chainHeadSub := mm.blockchain.SubscribeChainHeadEvent(chainHeadCh)
+	defer chainHeadSub.Unsubscribe()
+
+	txPreCh := make(chan core.TxPreEvent, 4096)
+	txPreSub := mm.txpool.SubscribeTxPreEvent(txPreCh)
+	defer txPreSub.Unsubscribe()
+
+	pingTicker := time.NewTicker(masternodePingInterval)
+	defer pingTicker.Stop()
+
+	s.refresh()
+	close(s.initDone)
+
+	for {
+		select {
+		case join := <-joinCh:
+			s.handleJoin(join)
+
+		case quit := <-quitCh:
+			s.handleQuit(quit)
+
+		case p := <-mm.newPeerCh:
+			// A freshly dialed eth peer can race the masternode handshake,
+			// so immediately re-announce this node's ping to it rather than
+			// waiting for the next pingTicker tick.
+			s.pingPeer(p)
+
+		case err := <-joinSub.Err():
+			log.Debug("Masternode join watch terminated", "err", err)
+			return
+
+		case err := <-quitSub.Err():
+			log.Debug("Masternode quit watch terminated", "err", err)
+			return
+
+		case <-chainHeadCh:
+			// A reorg or a new block can change whether our registered
+			// IP/port still matches what's on-chain, so re-evaluate.
+			s.refresh()
+
+		case <-txPreCh:
+			// Pending transactions don't change masternode state today, but
+			// routing them through this loop keeps a single funnel for every
+			// external trigger, ready for InstantSend-aware scoring to hook
+			// in without adding another goroutine.
+
+		case <-pingTicker.C:
+			s.broadcastPing()
+
+		case <-mm.quitSync:
+			log.Debug("masternodeSyncer shutting down")
+			return
+		}
+	}
+}
+
+// refresh re-evaluates the local active-masternode state, advances the
+// syncer's own state machine to match, and logs the current masternode set.
+func (s *masternodeSyncer) refresh() {
+	mm := s.mm
+
+	mm.updateActiveMasternode()
+	switch mm.active.State() {
+	case masternode.ACTIVE_MASTERNODE_STARTED:
+		s.setState(mnSyncStarted)
+	case masternode.ACTIVE_MASTERNODE_NOT_CAPABLE:
+		if !mm.srvr.Config.MasternodeAddr.IP.Equal(net.IP{}) {
+			s.setState(mnSyncSyncing)
+			log.Debug("Masternode registration transaction", "data", mm.registrationTxData())
+		} else {
+			s.setState(mnSyncNotCapable)
+		}
+	default:
+		s.setState(mnSyncSyncing)
+	}
+
+	mm.masternodes.Show()
+}
+
+func (s *masternodeSyncer) setState(state mnSyncState) {
+	if s.state == state {
+		return
+	}
+	log.Debug("Masternode sync state transition", "from", s.state, "to", state)
+	s.state = state
+}
+
+func (s *masternodeSyncer) handleJoin(join *contract.ContractJoin) {
+	mm := s.mm
+	log.Debug("Masternode join event", "id", common.Bytes2Hex(join.Id[:]))
+
+	node, err := mm.masternodes.NodeJoin(join.Id)
+	if err != nil {
+		log.Error("masternodeSyncer: NodeJoin failed", "err", err)
+		return
+	}
+	if bytes.Equal(join.Id[:], mm.srvr.Self().ID[0:32]) {
+		s.refresh()
+	} else {
+		mm.srvr.AddPeer(node.Node)
+	}
+	mm.masternodes.Show()
+}
+
+func (s *masternodeSyncer) handleQuit(quit *contract.ContractQuit) {
+	mm := s.mm
+	log.Debug("Masternode quit event", "id", common.Bytes2Hex(quit.Id[:]))
+
+	mm.masternodes.NodeQuit(quit.Id)
+	if bytes.Equal(quit.Id[:], mm.srvr.Self().ID[0:32]) {
+		// Update mm.active to reflect the quit, but don't run it through
+		// refresh's state-machine switch: MasternodeAddr.IP is still
+		// configured at this point, so refresh would immediately reclassify
+		// Expired as Syncing, making the transition unobservable.
+		mm.updateActiveMasternode()
+		s.setState(mnSyncExpired)
+	}
+	mm.masternodes.Show()
+}
+
+// pingPeer re-announces this node's active masternode to the
+// masternode-protocol counterpart of the freshly connected eth peer p, if
+// one is already registered, instead of waiting for the next ping tick.
+func (s *masternodeSyncer) pingPeer(p *peer) {
+	if s.state != mnSyncStarted {
+		return
+	}
+
+	mn := s.mm.mnPeers.Peer(p.id)
+	if mn == nil {
+		return
+	}
+	if err := p2p.Send(mn.rw, MasternodePingMsg, s.mm.active.ID); err != nil {
+		log.Debug("Masternode ping failed", "peer", mn.id, "err", err)
+	}
+}
+
+// broadcastPing re-announces this node's active masternode to every
+// connected masternode-protocol peer, so remote peers don't expire it during
+// long gaps between Join contract events.
+func (s *masternodeSyncer) broadcastPing() {
+	if s.state != mnSyncStarted {
+		return
+	}
+
+	mm := s.mm
+	for _, p := range mm.mnPeers.peersSnapshot() {
+		if err := p2p.Send(p.rw, MasternodePingMsg, mm.active.ID); err != nil {
+			log.Debug("Masternode ping failed", "peer", p.id, "err", err)
+		}
+	}
+}